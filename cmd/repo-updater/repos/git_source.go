@@ -0,0 +1,238 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// GitSourceConfig configures a GitSource. It is unmarshalled from the
+// OTHER external service's Config JSON.
+type GitSourceConfig struct {
+	// Root is the base URL or path of the plain git host to probe, e.g.
+	// "https://git.mycorp.com" for a cgit or gitolite instance.
+	Root string `json:"url"`
+
+	// ManifestURL, if set, is fetched and parsed as a newline-separated
+	// list of repository paths relative to Root, one per discovered
+	// repository.
+	ManifestURL string `json:"manifest,omitempty"`
+
+	// Path, if set, is walked using Glob to enumerate bare repositories on
+	// the local filesystem, rooted at Path.
+	Path string `json:"path,omitempty"`
+
+	// Glob is the pattern (relative to Path) used to find repository
+	// directories when Path is set, e.g. "*/*.git".
+	Glob string `json:"glob,omitempty"`
+}
+
+// GitSource discovers repositories hosted behind a plain git endpoint that
+// doesn't expose a host-specific API, such as cgit, gitolite, a gitea
+// mirror, or a tree of bare repositories on disk. It backs the OTHER
+// external service kind.
+type GitSource struct {
+	svc *ExternalService
+	cfg GitSourceConfig
+}
+
+// NewGitSource returns a GitSource that discovers repositories for svc,
+// configured by cfg.
+func NewGitSource(svc *ExternalService, cfg GitSourceConfig) *GitSource {
+	return &GitSource{svc: svc, cfg: cfg}
+}
+
+// ListRepos discovers repositories reachable from the configured root and
+// returns one repos.Repo per repository that responds to a git-upload-pack
+// probe.
+func (s *GitSource) ListRepos(ctx context.Context) ([]*Repo, error) {
+	urls, err := s.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*Repo, 0, len(urls))
+	for _, url := range urls {
+		r, err := s.makeRepo(ctx, url)
+		if err != nil {
+			log15.Warn("git_source: skipping undiscoverable repo", "url", url, "err", err)
+			continue
+		}
+		repos = append(repos, r)
+	}
+
+	return repos, nil
+}
+
+func (s *GitSource) discover(ctx context.Context) ([]string, error) {
+	switch {
+	case s.cfg.ManifestURL != "":
+		return s.discoverManifest(ctx)
+	case s.cfg.Path != "":
+		return s.discoverFS()
+	default:
+		return []string{s.cfg.Root}, nil
+	}
+}
+
+func (s *GitSource) discoverManifest(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.ManifestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("git_source: building manifest request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("git_source: fetching manifest %s: %w", s.cfg.ManifestURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("git_source: manifest %s returned status %d", s.cfg.ManifestURL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("git_source: reading manifest %s: %w", s.cfg.ManifestURL, err)
+	}
+
+	root := strings.TrimSuffix(s.cfg.Root, "/")
+
+	var urls []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, root+"/"+strings.TrimPrefix(line, "/"))
+	}
+
+	return urls, nil
+}
+
+func (s *GitSource) discoverFS() ([]string, error) {
+	fs := osfs.New(s.cfg.Path)
+
+	matches, err := util.Glob(fs, s.cfg.Glob)
+	if err != nil {
+		return nil, fmt.Errorf("git_source: globbing %q under %s: %w", s.cfg.Glob, s.cfg.Path, err)
+	}
+
+	urls := make([]string, 0, len(matches))
+	for _, m := range matches {
+		urls = append(urls, path.Join(s.cfg.Path, m))
+	}
+
+	return urls, nil
+}
+
+// maxRootCommitDepth bounds how much history makeRepo pulls down while
+// looking for a repo's root commit. A real cgit/gitolite host can serve
+// repos with huge histories, and discovery has to stay cheap even for
+// those, so a repo whose root commit isn't reached within this many
+// commits of HEAD is reported as undiscoverable instead of pulling its
+// entire object history into memory.
+const maxRootCommitDepth = 250
+
+// makeRepo clones cloneURL, bounded to maxRootCommitDepth commits, and
+// derives a stable ExternalRepo.ID from the root commit reachable from
+// HEAD so that the repo's identity survives renames of its display name
+// or path and doesn't change every time upstream gets a new commit the
+// way hashing the tip of HEAD would. The shallow clone itself doubles as
+// the reachability probe, so there's no separate ls-remote round trip
+// first.
+func (s *GitSource) makeRepo(ctx context.Context, cloneURL string) (*Repo, error) {
+	if _, err := transport.NewEndpoint(cloneURL); err != nil {
+		return nil, fmt.Errorf("invalid clone url %q: %w", cloneURL, err)
+	}
+
+	clone, err := git.CloneContext(ctx, memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:   cloneURL,
+		Depth: maxRootCommitDepth,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clone %s: %w", cloneURL, err)
+	}
+
+	head, err := clone.Head()
+	if err != nil {
+		return nil, fmt.Errorf("resolving HEAD of %s: %w", cloneURL, err)
+	}
+
+	root, err := rootCommit(clone, head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("walking to root commit of %s within %d commits of HEAD: %w", cloneURL, maxRootCommitDepth, err)
+	}
+
+	id := root.Hash.String()
+	key := sourceID(s.svc)
+
+	return &Repo{
+		Name:    gitRepoName(cloneURL),
+		Enabled: true,
+		ExternalRepo: api.ExternalRepoSpec{
+			ID:          id,
+			ServiceType: "git",
+			ServiceID:   s.cfg.Root,
+		},
+		Sources: map[string]*SourceInfo{
+			key: {
+				ID:       key,
+				CloneURL: cloneURL,
+			},
+		},
+	}, nil
+}
+
+// rootCommit walks the first-parent chain of repo starting at from until it
+// reaches a commit with no parents, and returns it. That root commit's hash
+// never changes as the branch it's an ancestor of gains new commits, unlike
+// the hash of from itself. It returns an error if repo's history was
+// shallow-cloned and the walk runs off the end of what was fetched before
+// reaching a parentless commit.
+func rootCommit(repo *git.Repository, from plumbing.Hash) (*object.Commit, error) {
+	commit, err := repo.CommitObject(from)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(commit.ParentHashes) > 0 {
+		parent, err := repo.CommitObject(commit.ParentHashes[0])
+		if err != nil {
+			return nil, err
+		}
+		commit = parent
+	}
+
+	return commit, nil
+}
+
+func sourceID(svc *ExternalService) string {
+	return fmt.Sprintf("extsvc:%d", svc.ID)
+}
+
+func gitRepoName(cloneURL string) string {
+	name := strings.TrimSuffix(cloneURL, ".git")
+	for _, prefix := range []string{"https://", "http://", "git://", "ssh://"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	if i := strings.LastIndex(name, "@"); i != -1 {
+		name = name[i+1:]
+	}
+	return strings.Replace(name, ":", "/", 1)
+}
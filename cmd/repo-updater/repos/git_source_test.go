@@ -0,0 +1,82 @@
+package repos_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	_ "github.com/go-git/go-git/v5/plumbing/transport/file"
+
+	"github.com/sourcegraph/sourcegraph/cmd/repo-updater/repos"
+)
+
+// initBareRepoWithHistory creates a bare git repository at dir with two
+// commits on its default branch, and returns the hash of the first
+// (root) commit.
+func initBareRepoWithHistory(t *testing.T, dir string) string {
+	t.Helper()
+
+	work := t.TempDir()
+	wt, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatalf("PlainInit worktree: %s", err)
+	}
+
+	commit := func(name, content string) string {
+		path := filepath.Join(work, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+
+		w, err := wt.Worktree()
+		if err != nil {
+			t.Fatalf("Worktree: %s", err)
+		}
+		if _, err = w.Add(name); err != nil {
+			t.Fatalf("Add %s: %s", name, err)
+		}
+
+		sig := &object.Signature{Name: "test", Email: "test@example.com"}
+		hash, err := w.Commit("commit "+name, &git.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatalf("Commit %s: %s", name, err)
+		}
+		return hash.String()
+	}
+
+	root := commit("root.txt", "root")
+	commit("second.txt", "second") // advances HEAD past the root commit
+
+	if err := os.Rename(work+"/.git", dir); err != nil {
+		t.Fatalf("renaming .git dir to bare clone path: %s", err)
+	}
+
+	return root
+}
+
+func TestGitSourceListRepos(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	root := initBareRepoWithHistory(t, dir)
+
+	svc := &repos.ExternalService{ID: 1, Kind: "OTHER"}
+	src := repos.NewGitSource(svc, repos.GitSourceConfig{Root: dir})
+
+	rs, err := src.ListRepos(context.Background())
+	if err != nil {
+		t.Fatalf("ListRepos error: %s", err)
+	}
+
+	if len(rs) != 1 {
+		t.Fatalf("expected 1 repo, got %d", len(rs))
+	}
+
+	if rs[0].ExternalRepo.ID != root {
+		t.Errorf("ExternalRepo.ID: have %q, want root commit %q", rs[0].ExternalRepo.ID, root)
+	}
+}
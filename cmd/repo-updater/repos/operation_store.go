@@ -0,0 +1,599 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpType identifies the kind of mutation an Operation records.
+type OpType string
+
+// The set of OpTypes an OperationStore can emit.
+const (
+	OpCreate OpType = "create"
+	OpUpdate OpType = "update"
+	OpDelete OpType = "delete"
+)
+
+// OpEntity identifies the kind of record an Operation was recorded against.
+type OpEntity string
+
+// The set of OpEntities an OperationStore can emit.
+const (
+	EntityRepo            OpEntity = "repo"
+	EntityExternalService OpEntity = "external_service"
+)
+
+// FieldChange is a single field that differs between the previous and the
+// current snapshot of an entity, as recorded by an Operation.
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// Operation is an immutable, append-only record of a single mutation
+// performed against a Repo or ExternalService via an OperationStore. Ops
+// form a total order of small, self-describing facts: folding the Diff of
+// every Operation recorded against a given EntityID reconstructs that
+// entity's state as of any point in time, which is what BuildSnapshot does
+// for Repo entities.
+type Operation struct {
+	Seq         int64 // monotonic, per-store sequence number
+	LogicalTime int64 // Lamport-style logical clock, incremented once per operation
+	WallTime    time.Time
+	Author      string // the external-service syncer that produced this operation
+	Entity      OpEntity
+	EntityID    string // stable identity of the mutated Repo or ExternalService
+	Type        OpType
+	Diff        []FieldChange
+}
+
+// OperationFilter narrows the results of OperationStore.ListOperations.
+type OperationFilter struct {
+	Entity   OpEntity
+	EntityID string
+	Author   string
+}
+
+func (f OperationFilter) matches(op Operation) bool {
+	if f.Entity != "" && f.Entity != op.Entity {
+		return false
+	}
+	if f.EntityID != "" && f.EntityID != op.EntityID {
+		return false
+	}
+	if f.Author != "" && f.Author != op.Author {
+		return false
+	}
+	return true
+}
+
+// OperationStore decorates a Store, recording every UpsertRepos,
+// UpsertExternalServices and soft-delete as an append-only Operation. It
+// sits alongside ObservedStore in the decorator chain and is typically the
+// outermost layer so that every mutation that reaches the underlying Store
+// is captured, including those performed inside a transaction.
+//
+// Consumers that only care about incremental changes (the search indexer,
+// the permissions syncer) can call ListOperations with a cursor instead of
+// diffing full ListRepos snapshots, and BuildSnapshot lets anyone replay a
+// entity's operations to answer "what did this repo look like, and why did
+// it change".
+type OperationStore struct {
+	Store
+	Author string
+
+	mu     sync.Mutex // guards seq, clock, ops, snaps and esnaps
+	seq    int64
+	clock  int64
+	ops    []Operation
+	snaps  map[string]*Repo
+	esnaps map[string]*ExternalService
+
+	// repoLocks and esvcLocks serialize UpsertRepos/UpsertExternalServices
+	// calls that touch the same entity across the underlying Store call,
+	// without serializing calls that touch different entities behind them.
+	repoLocks keyedMutex
+	esvcLocks keyedMutex
+
+	// record durably appends ops produced by this store. Outside of a
+	// transaction it assigns sequence numbers immediately; inside one, it
+	// buffers them until the transaction commits.
+	record func([]Operation)
+}
+
+// NewOperationStore returns an OperationStore that decorates s, attributing
+// every operation it records to author (typically the name of the
+// external-service syncer driving the call).
+func NewOperationStore(s Store, author string) *OperationStore {
+	os := &OperationStore{
+		Store:  s,
+		Author: author,
+		snaps:  map[string]*Repo{},
+		esnaps: map[string]*ExternalService{},
+	}
+	os.record = os.append
+	return os
+}
+
+// keyedMutex hands out one *sync.Mutex per key, so callers holding a lock
+// for one key never block callers locking a different key behind them. Its
+// own internal mutex is only held long enough to look up or create the
+// per-key lock, never for the duration the caller holds it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock acquires the locks for every key in keys, in sorted order so that
+// two calls locking overlapping key sets can never deadlock on each other,
+// and returns a func that releases them all.
+func (k *keyedMutex) lock(keys []string) func() {
+	unique := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		unique[key] = true
+	}
+
+	sorted := make([]string, 0, len(unique))
+	for key := range unique {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*sync.Mutex{}
+	}
+	held := make([]*sync.Mutex, len(sorted))
+	for i, key := range sorted {
+		l, ok := k.locks[key]
+		if !ok {
+			l = &sync.Mutex{}
+			k.locks[key] = l
+		}
+		held[i] = l
+	}
+	k.mu.Unlock()
+
+	for _, l := range held {
+		l.Lock()
+	}
+
+	return func() {
+		for _, l := range held {
+			l.Unlock()
+		}
+	}
+}
+
+func (s *OperationStore) append(ops []Operation) {
+	if len(ops) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range ops {
+		s.seq++
+		s.clock++
+		ops[i].Seq = s.seq
+		ops[i].LogicalTime = s.clock
+	}
+
+	s.ops = append(s.ops, ops...)
+}
+
+// ListOperations returns, in the order they were recorded, every Operation
+// with a sequence number greater than since that matches filter.
+func (s *OperationStore) ListOperations(ctx context.Context, since int64, filter OperationFilter) ([]Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ops []Operation
+	for _, op := range s.ops {
+		if op.Seq <= since || !filter.matches(op) {
+			continue
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// ListReposForSync returns the compact sync projection (ID, ExternalRepo,
+// UpstreamFingerprint, UpdatedAt) of every non-deleted repo of the given
+// kinds known to this store, without touching the underlying Store. It
+// backs Syncer.Sync's SyncIncremental mode and is served from the same
+// snapshot cache UpsertRepos diffs against, so it stays cheap
+// even when the underlying Store would otherwise have to materialize full
+// Repo rows.
+//
+// Soft-deleted repos are excluded the same way ListRepos excludes them by
+// default: an IncrementalSource is handed known fingerprints and allowed
+// to pass the matching Repo through unchanged when nothing's changed, so
+// a deleted repo's fingerprint must never reach known, or an incremental
+// sync would resurrect it by upserting its last-known, not-deleted state.
+func (s *OperationStore) ListReposForSync(ctx context.Context, kinds []string) ([]RepoSyncFingerprint, error) {
+	want := make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		want[strings.ToLower(k)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fps := make([]RepoSyncFingerprint, 0, len(s.snaps))
+	for _, r := range s.snaps {
+		if !r.DeletedAt.IsZero() {
+			continue
+		}
+		if len(want) > 0 && !want[strings.ToLower(r.ExternalRepo.ServiceType)] {
+			continue
+		}
+		fps = append(fps, RepoSyncFingerprint{
+			ID:                  r.ID,
+			ExternalRepo:        r.ExternalRepo,
+			UpstreamFingerprint: r.UpstreamFingerprint,
+			UpdatedAt:           r.UpdatedAt,
+		})
+	}
+
+	sort.Slice(fps, func(i, j int) bool { return fps[i].ID < fps[j].ID })
+	return fps, nil
+}
+
+// BuildSnapshot folds ops, which must all belong to the same EntityRepo, in
+// the order given to reconstruct that repo's state as of the last
+// operation. It returns ErrSnapshotDeleted if the entity was deleted by the
+// time the last operation was applied.
+//
+// Folding sets each field of the returned Repo directly via reflection from
+// the concrete value diffFields recorded, rather than round-tripping the
+// whole state map through JSON: a JSON round-trip would decay Repo.Metadata
+// (an interface{} holding a code-host-specific struct) and Repo.Sources (a
+// pointer-valued map) into generic map[string]interface{} values instead of
+// reproducing the types ListRepos would actually return.
+func BuildSnapshot(ops []Operation) (*Repo, error) {
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("operations: no operations to replay")
+	}
+
+	state := map[string]interface{}{}
+
+	for i, op := range ops {
+		if op.Entity != EntityRepo {
+			return nil, fmt.Errorf("operations: BuildSnapshot only replays %q entities, got %q at index %d", EntityRepo, op.Entity, i)
+		}
+
+		for _, fc := range op.Diff {
+			state[fc.Field] = fc.New
+		}
+	}
+
+	if deletedAt, ok := state["DeletedAt"].(time.Time); ok && !deletedAt.IsZero() {
+		return nil, ErrSnapshotDeleted
+	}
+
+	r := &Repo{}
+	rv := reflect.ValueOf(r).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		v, ok := state[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+
+		vv := reflect.ValueOf(v)
+		fv := rv.Field(i)
+		if !vv.Type().AssignableTo(fv.Type()) {
+			return nil, fmt.Errorf("operations: field %s: recorded value of type %s is not assignable to %s", f.Name, vv.Type(), fv.Type())
+		}
+
+		fv.Set(vv)
+	}
+
+	return r, nil
+}
+
+// ErrSnapshotDeleted is returned by BuildSnapshot when the replayed
+// operations end with the entity being deleted.
+var ErrSnapshotDeleted = fmt.Errorf("operations: entity was deleted")
+
+func (s *OperationStore) UpsertRepos(ctx context.Context, rs ...*Repo) error {
+	// repoLocks is held across the whole before-snapshot -> Store call ->
+	// after-snapshot sequence, not just around the s.snaps writes: two
+	// concurrent UpsertRepos calls touching the same repo (the exact case
+	// this store exists to audit) must not interleave their before-reads,
+	// or the diff one of them records will be computed against a state the
+	// other one already overwrote. It's scoped to the repos actually being
+	// upserted, so it never blocks a concurrent call touching disjoint
+	// repos behind the underlying Store's I/O.
+	keys := make([]string, len(rs))
+	for i, r := range rs {
+		keys[i] = repoOpKey(r)
+	}
+	unlock := s.repoLocks.lock(keys)
+	defer unlock()
+
+	// Snapshot the previously recorded state of each repo, keyed by its
+	// caller-supplied ExternalRepo identity, *before* handing rs to the
+	// underlying Store: that call may mutate rs in place (e.g. assigning
+	// Repo.ID on creation), and the diff must be computed against what we
+	// knew last, not against rs's own pre-call clone.
+	s.mu.Lock()
+	before := make([]*Repo, len(rs))
+	existed := make([]bool, len(rs))
+	for i, r := range rs {
+		if prev, ok := s.snaps[repoOpKey(r)]; ok {
+			before[i], existed[i] = prev, true
+		} else {
+			before[i] = &Repo{}
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.Store.UpsertRepos(ctx, rs...); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ops := make([]Operation, 0, len(rs))
+	s.mu.Lock()
+	for i, r := range rs {
+		key := repoOpKey(r)
+		op := Operation{
+			WallTime: now,
+			Author:   s.Author,
+			Entity:   EntityRepo,
+			EntityID: key,
+			Type:     repoOpType(existed[i], before[i], r),
+			Diff:     diffFields(before[i], r),
+		}
+		if op.Diff == nil && op.Type != OpDelete {
+			continue // nothing actually changed
+		}
+
+		ops = append(ops, op)
+		s.snaps[key] = r.Clone()
+	}
+	s.mu.Unlock()
+
+	s.record(ops)
+	return nil
+}
+
+func (s *OperationStore) UpsertExternalServices(ctx context.Context, svcs ...*ExternalService) error {
+	// Like UpsertRepos, the lock guards the whole before-snapshot -> Store
+	// call -> after-snapshot sequence so concurrent callers mutating the
+	// same ExternalService can't race on s.esnaps, but it's scoped to the
+	// services actually being upserted rather than every ExternalService
+	// this store knows about. Unlike a Repo's ExternalRepo identity, a
+	// brand new ExternalService's ID is only assigned by the call itself,
+	// so an unset ID is a key of its own: it locks out other concurrent
+	// creates from racing on the same not-yet-assigned identity without
+	// serializing against unrelated, already-identified services.
+	keys := make([]string, len(svcs))
+	for i, e := range svcs {
+		keys[i] = extSvcOpKey(e)
+	}
+	unlock := s.esvcLocks.lock(keys)
+	defer unlock()
+
+	s.mu.Lock()
+	before := make([]*ExternalService, len(svcs))
+	existed := make([]bool, len(svcs))
+	for i, e := range svcs {
+		if e.ID != 0 {
+			if prev, ok := s.esnaps[extSvcOpKey(e)]; ok {
+				before[i], existed[i] = prev, true
+			}
+		}
+		if before[i] == nil {
+			before[i] = &ExternalService{}
+		}
+	}
+	s.mu.Unlock()
+
+	if err := s.Store.UpsertExternalServices(ctx, svcs...); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ops := make([]Operation, 0, len(svcs))
+	s.mu.Lock()
+	for i, e := range svcs {
+		key := extSvcOpKey(e)
+		op := Operation{
+			WallTime: now,
+			Author:   s.Author,
+			Entity:   EntityExternalService,
+			EntityID: key,
+			Type:     extSvcOpType(existed[i], before[i], e),
+			Diff:     diffFields(before[i], e),
+		}
+		if op.Diff == nil && op.Type != OpDelete {
+			continue
+		}
+
+		ops = append(ops, op)
+		s.esnaps[key] = e.Clone()
+	}
+	s.mu.Unlock()
+
+	s.record(ops)
+	return nil
+}
+
+// Transact returns a TxStore that buffers every Operation it would record
+// and only makes them visible, with sequence numbers assigned, once Done is
+// called without an error. If the transaction is rolled back, the buffered
+// operations are discarded and the parent OperationStore's sequence counter
+// is left untouched.
+func (s *OperationStore) Transact(ctx context.Context) (TxStore, error) {
+	tr, ok := s.Store.(Transactor)
+	if !ok {
+		return nil, fmt.Errorf("operations: store %T is not transactable", s.Store)
+	}
+
+	txStore, err := tr.Transact(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// s.snaps/s.esnaps are read here under s.mu for the same reason
+	// UpsertRepos/UpsertExternalServices write them under it: a concurrent
+	// upsert against the parent store must not be caught mid-write.
+	s.mu.Lock()
+	snaps := cloneRepoSnaps(s.snaps)
+	esnaps := cloneExtSvcSnaps(s.esnaps)
+	s.mu.Unlock()
+
+	tx := &OperationStore{
+		Store:  txStore,
+		Author: s.Author,
+		snaps:  snaps,
+		esnaps: esnaps,
+	}
+
+	pending := &[]Operation{}
+	tx.record = func(ops []Operation) { *pending = append(*pending, ops...) }
+
+	return &operationStoreTx{OperationStore: tx, tx: txStore, parent: s, pending: pending}, nil
+}
+
+type operationStoreTx struct {
+	*OperationStore
+	tx      TxStore
+	parent  *OperationStore
+	pending *[]Operation
+}
+
+func (tx *operationStoreTx) Done(errs ...*error) {
+	tx.tx.Done(errs...)
+
+	for _, e := range errs {
+		if e != nil && *e != nil {
+			return // rolled back: discard the buffered operations and snapshots
+		}
+	}
+
+	tx.parent.mu.Lock()
+	for k, v := range tx.snaps {
+		tx.parent.snaps[k] = v
+	}
+	for k, v := range tx.esnaps {
+		tx.parent.esnaps[k] = v
+	}
+	tx.parent.mu.Unlock()
+
+	tx.parent.append(*tx.pending)
+}
+
+func cloneRepoSnaps(snaps map[string]*Repo) map[string]*Repo {
+	clone := make(map[string]*Repo, len(snaps))
+	for k, v := range snaps {
+		clone[k] = v.Clone()
+	}
+	return clone
+}
+
+func cloneExtSvcSnaps(snaps map[string]*ExternalService) map[string]*ExternalService {
+	clone := make(map[string]*ExternalService, len(snaps))
+	for k, v := range snaps {
+		clone[k] = v.Clone()
+	}
+	return clone
+}
+
+func repoOpKey(r *Repo) string {
+	return fmt.Sprintf("%s:%s:%s", r.ExternalRepo.ServiceID, r.ExternalRepo.ServiceType, r.ExternalRepo.ID)
+}
+
+func extSvcOpKey(e *ExternalService) string {
+	return fmt.Sprintf("%s:%d", e.Kind, e.ID)
+}
+
+func repoOpType(existed bool, before, after *Repo) OpType {
+	switch {
+	case !existed:
+		return OpCreate
+	case !after.DeletedAt.IsZero() && before.DeletedAt.IsZero():
+		return OpDelete
+	default:
+		return OpUpdate
+	}
+}
+
+func extSvcOpType(existed bool, before, after *ExternalService) OpType {
+	switch {
+	case !existed:
+		return OpCreate
+	case !after.DeletedAt.IsZero() && before.DeletedAt.IsZero():
+		return OpDelete
+	default:
+		return OpUpdate
+	}
+}
+
+// diffFields returns the set of exported fields that differ between old
+// and new, sorted by field name for a stable, compact diff.
+func diffFields(oldV, newV interface{}) []FieldChange {
+	oldFields := fieldsOf(oldV)
+	newFields := fieldsOf(newV)
+
+	names := map[string]bool{}
+	for name := range oldFields {
+		names[name] = true
+	}
+	for name := range newFields {
+		names[name] = true
+	}
+
+	var changes []FieldChange
+	for name := range names {
+		ov, nv := oldFields[name], newFields[name]
+		if !reflect.DeepEqual(ov, nv) {
+			changes = append(changes, FieldChange{Field: name, Old: ov, New: nv})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// fieldsOf returns every exported field of v, which must be a struct or a
+// pointer to a struct, keyed by its Go field name. It uses reflection
+// rather than a JSON round-trip so that a field's concrete type (notably
+// Repo.Metadata and Repo.Sources) survives being carried in a FieldChange
+// and later replayed by BuildSnapshot.
+func fieldsOf(v interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	rt := rv.Type()
+	fields := make(map[string]interface{}, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		if f := rt.Field(i); f.PkgPath == "" { // exported
+			fields[f.Name] = rv.Field(i).Interface()
+		}
+	}
+
+	return fields
+}
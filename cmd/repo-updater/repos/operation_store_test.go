@@ -0,0 +1,196 @@
+package repos_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/sourcegraph/sourcegraph/cmd/repo-updater/repos"
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc/github"
+)
+
+func TestOperationStore(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		test func(repos.Store) func(*testing.T)
+	}{
+		{"EmitsOperationsInOrder", testOperationStoreEmitsInOrder},
+		{"RollbackDiscardsOperations", testOperationStoreRollback},
+		{"ReplayReproducesListRepos", testOperationStoreReplay},
+	} {
+		t.Run(tc.name, tc.test(repos.NewOperationStore(
+			new(repos.FakeStore),
+			"github.com/test/syncer",
+		)))
+	}
+}
+
+func testOperationStoreEmitsInOrder(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ops := store.(*repos.OperationStore)
+		ctx := context.Background()
+		now := time.Now()
+
+		repo := &repos.Repo{
+			Name: "github.com/foo/bar",
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          "AAAAA==",
+				ServiceType: "github",
+				ServiceID:   "http://github.com",
+			},
+			Sources:  map[string]*repos.SourceInfo{},
+			Metadata: new(github.Repository),
+		}
+
+		if err := ops.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		repo.Description = "updated"
+		if err := ops.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		repo.DeletedAt = now
+		if err := ops.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		got, err := ops.ListOperations(ctx, 0, repos.OperationFilter{})
+		if err != nil {
+			t.Fatalf("ListOperations error: %s", err)
+		}
+
+		if len(got) != 3 {
+			t.Fatalf("expected 3 operations, got %d", len(got))
+		}
+
+		wantTypes := []repos.OpType{repos.OpCreate, repos.OpUpdate, repos.OpDelete}
+		for i, op := range got {
+			if op.Seq != int64(i+1) {
+				t.Errorf("operation %d: want seq %d, have %d", i, i+1, op.Seq)
+			}
+			if op.Type != wantTypes[i] {
+				t.Errorf("operation %d: want type %s, have %s", i, wantTypes[i], op.Type)
+			}
+		}
+	}
+}
+
+func testOperationStoreRollback(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ops := store.(*repos.OperationStore)
+		ctx := context.Background()
+
+		repo := &repos.Repo{
+			Name: "github.com/foo/rollback",
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          "rollback",
+				ServiceType: "github",
+				ServiceID:   "http://github.com",
+			},
+			Sources:  map[string]*repos.SourceInfo{},
+			Metadata: new(github.Repository),
+		}
+
+		tx, err := ops.Transact(ctx)
+		if err != nil {
+			t.Fatalf("Transact error: %s", err)
+		}
+
+		if err = tx.(repos.Store).UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		rollback := context.Canceled
+		tx.Done(&rollback)
+
+		got, err := ops.ListOperations(ctx, 0, repos.OperationFilter{})
+		if err != nil {
+			t.Fatalf("ListOperations error: %s", err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("expected no operations after rollback, got %d", len(got))
+		}
+
+		tx, err = ops.Transact(ctx)
+		if err != nil {
+			t.Fatalf("Transact error: %s", err)
+		}
+		if err = tx.(repos.Store).UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+		tx.Done()
+
+		got, err = ops.ListOperations(ctx, 0, repos.OperationFilter{})
+		if err != nil {
+			t.Fatalf("ListOperations error: %s", err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("expected 1 operation after commit, got %d", len(got))
+		}
+	}
+}
+
+func testOperationStoreReplay(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ops := store.(*repos.OperationStore)
+		ctx := context.Background()
+
+		repo := &repos.Repo{
+			Name:        "github.com/foo/replay",
+			Description: "first",
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          "replay",
+				ServiceType: "github",
+				ServiceID:   "http://github.com",
+			},
+			Sources:  map[string]*repos.SourceInfo{},
+			Metadata: new(github.Repository),
+		}
+
+		if err := ops.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		repo.Description = "second"
+		if err := ops.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("UpsertRepos error: %s", err)
+		}
+
+		recorded, err := ops.ListOperations(ctx, 0, repos.OperationFilter{
+			Entity:   repos.EntityRepo,
+			EntityID: "http://github.com:github:replay",
+		})
+		if err != nil {
+			t.Fatalf("ListOperations error: %s", err)
+		}
+
+		snapshot, err := repos.BuildSnapshot(recorded)
+		if err != nil {
+			t.Fatalf("BuildSnapshot error: %s", err)
+		}
+
+		have, err := ops.ListRepos(ctx, repos.StoreListReposArgs{Names: []string{repo.Name}})
+		if err != nil {
+			t.Fatalf("ListRepos error: %s", err)
+		}
+		if len(have) != 1 {
+			t.Fatalf("expected 1 repo, got %d", len(have))
+		}
+
+		if diff := pretty.Compare(snapshot, have[0]); diff != "" {
+			t.Errorf("replayed snapshot doesn't match ListRepos:\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// storePanicsTotal counts panics recovered from a Store method call, by
+// method name and (where derivable from the call's arguments) external
+// service kind, so an operator can tell a single flaky sync apart from a
+// Store-wide regression without having to grep logs for ErrPanic.
+var storePanicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "src",
+	Subsystem: "repoupdater",
+	Name:      "store_panics_total",
+	Help:      "Total number of panics recovered from repos.Store method calls.",
+}, []string{"method", "kind"})
+
+func init() {
+	prometheus.MustRegister(storePanicsTotal)
+}
+
+// ErrPanic is the error RecoveryStore converts a recovered panic into. It
+// carries everything needed to triage the panic after the fact: which
+// Store method it came from, the value recovered, and a symbolized stack
+// trace captured at the point of recovery.
+type ErrPanic struct {
+	Method string
+	Value  interface{}
+	Stack  []byte
+}
+
+func (e *ErrPanic) Error() string {
+	return fmt.Sprintf("repos: recovered from panic in Store.%s: %v\n%s", e.Method, e.Value, e.Stack)
+}
+
+// RecoveryStore decorates a Store, converting panics raised by
+// UpsertRepos, UpsertExternalServices, ListRepos, ListExternalServices or
+// Transact into an *ErrPanic instead of letting them crash the process.
+// Every recovered panic is logged and counted in storePanicsTotal, labeled
+// by method and (when available) external service kind.
+//
+// Because every wrapped method recovers before returning control to the
+// caller, a panic never unwinds past a RecoveryStore: a caller's own
+// `tx, err := store.Transact(ctx); defer tx.Done(&err)` always runs Done
+// as an ordinary deferred call, never mid-panic, so a write that panics
+// inside a transaction still rolls that transaction back instead of
+// leaking it.
+type RecoveryStore struct {
+	Store
+	Log log15.Logger
+}
+
+// NewRecoveryStore returns a RecoveryStore decorating s. If logger is nil,
+// log15.Root() is used.
+func NewRecoveryStore(s Store, logger log15.Logger) *RecoveryStore {
+	if logger == nil {
+		logger = log15.Root()
+	}
+	return &RecoveryStore{Store: s, Log: logger}
+}
+
+func (s *RecoveryStore) recover(method, kind string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	storePanicsTotal.WithLabelValues(method, kind).Inc()
+	s.Log.Error("repos.RecoveryStore: recovered from panic", "method", method, "panic", r, "stack", string(stack))
+
+	*err = &ErrPanic{Method: method, Value: r, Stack: stack}
+}
+
+func (s *RecoveryStore) UpsertRepos(ctx context.Context, rs ...*Repo) (err error) {
+	defer s.recover("UpsertRepos", repoKinds(rs), &err)
+	return s.Store.UpsertRepos(ctx, rs...)
+}
+
+func (s *RecoveryStore) UpsertExternalServices(ctx context.Context, svcs ...*ExternalService) (err error) {
+	defer s.recover("UpsertExternalServices", extSvcKinds(svcs), &err)
+	return s.Store.UpsertExternalServices(ctx, svcs...)
+}
+
+func (s *RecoveryStore) ListRepos(ctx context.Context, args StoreListReposArgs) (rs Repos, err error) {
+	defer s.recover("ListRepos", strings.Join(args.Kinds, ","), &err)
+	return s.Store.ListRepos(ctx, args)
+}
+
+func (s *RecoveryStore) ListExternalServices(ctx context.Context, args StoreListExternalServicesArgs) (es ExternalServices, err error) {
+	defer s.recover("ListExternalServices", strings.Join(args.Kinds, ","), &err)
+	return s.Store.ListExternalServices(ctx, args)
+}
+
+// Transact returns a TxStore that is itself a RecoveryStore, so every
+// method called through it keeps recovering panics the same way.
+func (s *RecoveryStore) Transact(ctx context.Context) (ts TxStore, err error) {
+	defer s.recover("Transact", "", &err)
+
+	tr, ok := s.Store.(Transactor)
+	if !ok {
+		return nil, fmt.Errorf("repos: store %T is not transactable", s.Store)
+	}
+
+	txStore, err := tr.Transact(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recoveryStoreTx{
+		RecoveryStore: &RecoveryStore{Store: txStore, Log: s.Log},
+		tx:            txStore,
+	}, nil
+}
+
+type recoveryStoreTx struct {
+	*RecoveryStore
+	tx TxStore
+}
+
+func (tx *recoveryStoreTx) Done(errs ...*error) {
+	tx.tx.Done(errs...)
+}
+
+func repoKinds(rs []*Repo) string {
+	kinds := map[string]bool{}
+	for _, r := range rs {
+		kinds[strings.ToLower(r.ExternalRepo.ServiceType)] = true
+	}
+	return joinKinds(kinds)
+}
+
+func extSvcKinds(svcs []*ExternalService) string {
+	kinds := map[string]bool{}
+	for _, e := range svcs {
+		kinds[strings.ToLower(e.Kind)] = true
+	}
+	return joinKinds(kinds)
+}
+
+func joinKinds(kinds map[string]bool) string {
+	list := make([]string, 0, len(kinds))
+	for k := range kinds {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -2,6 +2,7 @@ package repos_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
@@ -35,6 +36,87 @@ func TestFakeStore(t *testing.T) {
 			log15.Root(),
 		)))
 	}
+
+	t.Run("RecoveryStore", testRecoveryStorePanic(repos.NewRecoveryStore(
+		&panickingStore{Store: repos.NewObservedStore(
+			new(repos.FakeStore),
+			log15.Root(),
+		)},
+		log15.Root(),
+	)))
+}
+
+// panickingStore is injected between FakeStore and RecoveryStore to
+// exercise RecoveryStore's panic recovery: every UpsertRepos call panics,
+// simulating a bug further down the decorator chain.
+type panickingStore struct {
+	repos.Store
+}
+
+func (p *panickingStore) UpsertRepos(ctx context.Context, rs ...*repos.Repo) error {
+	panic("panickingStore: simulated UpsertRepos failure")
+}
+
+func (p *panickingStore) Transact(ctx context.Context) (repos.TxStore, error) {
+	tr, ok := p.Store.(repos.Transactor)
+	if !ok {
+		return nil, fmt.Errorf("panickingStore: store %T is not transactable", p.Store)
+	}
+
+	txStore, err := tr.Transact(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &panickingStoreTx{panickingStore: &panickingStore{Store: txStore}, tx: txStore}, nil
+}
+
+type panickingStoreTx struct {
+	*panickingStore
+	tx repos.TxStore
+}
+
+func (tx *panickingStoreTx) Done(errs ...*error) {
+	tx.tx.Done(errs...)
+}
+
+func testRecoveryStorePanic(store *repos.RecoveryStore) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ctx := context.Background()
+
+		t.Run("panicking write returns ErrPanic and rolls back", transact(ctx, store, func(t testing.TB, tx repos.Store) {
+			repo := &repos.Repo{
+				Name: "github.com/foo/panic",
+				ExternalRepo: api.ExternalRepoSpec{
+					ID:          "panic",
+					ServiceType: "github",
+					ServiceID:   "http://github.com",
+				},
+				Sources:  map[string]*repos.SourceInfo{},
+				Metadata: new(github.Repository),
+			}
+
+			err := tx.UpsertRepos(ctx, repo)
+
+			var panicErr *repos.ErrPanic
+			if !errors.As(err, &panicErr) {
+				t.Fatalf("expected *repos.ErrPanic, got %T: %v", err, err)
+			}
+			if panicErr.Method != "UpsertRepos" {
+				t.Errorf("ErrPanic.Method: have %q, want %q", panicErr.Method, "UpsertRepos")
+			}
+
+			// transact's own deferred Done(&errRollback) rolls this
+			// transaction back, proving a panic recovered by
+			// RecoveryStore doesn't stop Done from running as an
+			// ordinary deferred call. This subtest never calls
+			// tx.Transact itself, so it doesn't drive noopTxStore's
+			// own nested-transaction count invariant; it only proves the
+			// outer rollback still happens around a panicking write.
+		}))
+	}
 }
 
 func testStoreListExternalServices(store repos.Store) func(*testing.T) {
@@ -636,6 +718,30 @@ func testStoreListRepos(store repos.Store) func(*testing.T) {
 		repos: repos.Assert.ReposEqual(&github, &gitlab),
 	})
 
+	gitDiscovered := repos.Repo{
+		Name: "git-host.mycorp.com/org/bare",
+		ExternalRepo: api.ExternalRepoSpec{
+			ID:          "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+			ServiceType: "git",
+			ServiceID:   "https://git-host.mycorp.com",
+		},
+		Sources: map[string]*repos.SourceInfo{
+			"extsvc:5": {
+				ID:       "extsvc:5",
+				CloneURL: "https://git-host.mycorp.com/org/bare.git",
+			},
+		},
+	}
+
+	testCases = append(testCases, testCase{
+		name:   "round-trips git-protocol discovered repos",
+		stored: repos.Repos{&gitDiscovered},
+		args: func(repos.Repos) repos.StoreListReposArgs {
+			return repos.StoreListReposArgs{Kinds: []string{"git"}}
+		},
+		repos: repos.Assert.ReposEqual(&gitDiscovered),
+	})
+
 	return func(t *testing.T) {
 		t.Helper()
 
@@ -664,6 +770,36 @@ func testStoreListRepos(store repos.Store) func(*testing.T) {
 				}
 			}))
 		}
+
+		ctx := context.Background()
+		t.Run("git-protocol repo ids are stable across re-sync", transact(ctx, store, func(t testing.TB, tx repos.Store) {
+			repo := gitDiscovered.Clone()
+			if err := tx.UpsertRepos(ctx, repo); err != nil {
+				t.Fatalf("failed to setup store: %v", err)
+			}
+
+			repo.Name = "git-host.mycorp.com/org/renamed"
+			if err := tx.UpsertRepos(ctx, repo); err != nil {
+				t.Fatalf("UpsertRepos error: %s", err)
+			}
+
+			rs, err := tx.ListRepos(ctx, repos.StoreListReposArgs{Kinds: []string{"git"}})
+			if err != nil {
+				t.Fatalf("ListRepos error: %s", err)
+			}
+
+			if len(rs) != 1 {
+				t.Fatalf("expected 1 repo, got %d", len(rs))
+			}
+
+			if rs[0].ExternalRepo.ID != gitDiscovered.ExternalRepo.ID {
+				t.Errorf("ExternalRepo.ID changed across re-sync: have %q, want %q", rs[0].ExternalRepo.ID, gitDiscovered.ExternalRepo.ID)
+			}
+
+			if rs[0].Name != repo.Name {
+				t.Errorf("display name wasn't updated: have %q, want %q", rs[0].Name, repo.Name)
+			}
+		}))
 	}
 }
 
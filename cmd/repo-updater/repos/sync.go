@@ -0,0 +1,145 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// SyncMode controls how aggressively Syncer re-fetches repository metadata
+// from the configured code host APIs.
+type SyncMode int
+
+const (
+	// SyncFull always asks every Source for full repository metadata,
+	// regardless of whether anything has changed upstream.
+	SyncFull SyncMode = iota
+
+	// SyncIncremental trusts the locally stored Repo.UpstreamFingerprint:
+	// a Source implementing IncrementalSource is only asked to refetch a
+	// repo's full metadata when its own conditional request against the
+	// code host (an ETag, a since= cursor, a last_activity_after filter)
+	// reports the repo has actually changed since the last sync.
+	SyncIncremental
+)
+
+// RepoSyncFingerprint is the compact projection of a Repo used by the sync
+// loop to decide whether a repo needs refetching, without materializing
+// its full metadata.
+type RepoSyncFingerprint struct {
+	ID                  uint32
+	ExternalRepo        api.ExternalRepoSpec
+	UpstreamFingerprint string
+	UpdatedAt           time.Time
+}
+
+// syncStore is implemented by a Store that can answer ListReposForSync
+// more cheaply than a full ListRepos call, such as OperationStore serving
+// it from its in-memory snapshot cache. It's kept unexported and checked
+// via a type assertion in listReposForSync, the same way Transactor is;
+// any Store that doesn't implement it still gets correct (if pricier)
+// fingerprints from the fallback in listReposForSync.
+type syncStore interface {
+	ListReposForSync(ctx context.Context, kinds []string) ([]RepoSyncFingerprint, error)
+}
+
+// listReposForSync returns the compact sync projection of every repo of
+// the given kinds known to store. It prefers store's own ListReposForSync
+// when available, and otherwise derives the same projection from a full
+// ListRepos call so that SyncIncremental works against any Store.
+func listReposForSync(ctx context.Context, store Store, kinds []string) ([]RepoSyncFingerprint, error) {
+	if ss, ok := store.(syncStore); ok {
+		return ss.ListReposForSync(ctx, kinds)
+	}
+
+	rs, err := store.ListRepos(ctx, StoreListReposArgs{Kinds: kinds})
+	if err != nil {
+		return nil, err
+	}
+
+	fps := make([]RepoSyncFingerprint, len(rs))
+	for i, r := range rs {
+		fps[i] = RepoSyncFingerprint{
+			ID:                  r.ID,
+			ExternalRepo:        r.ExternalRepo,
+			UpstreamFingerprint: r.UpstreamFingerprint,
+			UpdatedAt:           r.UpdatedAt,
+		}
+	}
+
+	return fps, nil
+}
+
+// IncrementalSource is implemented by Sources that can cheaply tell, via a
+// conditional request against their code host, whether a repo's metadata
+// needs refetching. ListReposSince must return, for every repo whose
+// upstream fingerprint in known is still current, the same Repo it
+// returned the last time ListRepos or ListReposSince was called for it,
+// untouched.
+type IncrementalSource interface {
+	Source
+	ListReposSince(ctx context.Context, known map[string]RepoSyncFingerprint) ([]*Repo, error)
+}
+
+// Syncer drives the repo-updater sync loop: it asks every configured
+// Source to list its repositories and upserts the result into Store.
+type Syncer struct {
+	Store   Store
+	Sources []Source
+	Mode    SyncMode
+}
+
+// Sync lists repos from every configured Source and upserts them into
+// Store. In SyncIncremental mode, Sources implementing IncrementalSource
+// are handed the currently stored fingerprints (obtained via
+// listReposForSync) so they can skip refetching repos whose
+// upstream-reported fingerprint hasn't changed, passing through the
+// stored Repo unchanged instead.
+func (s *Syncer) Sync(ctx context.Context, kinds []string) error {
+	var known map[string]RepoSyncFingerprint
+
+	if s.Mode == SyncIncremental {
+		fps, err := listReposForSync(ctx, s.Store, kinds)
+		if err != nil {
+			return fmt.Errorf("sync: listing fingerprints: %w", err)
+		}
+
+		known = make(map[string]RepoSyncFingerprint, len(fps))
+		for _, fp := range fps {
+			known[fingerprintKey(fp.ExternalRepo)] = fp
+		}
+	}
+
+	var all []*Repo
+	for _, src := range s.Sources {
+		rs, err := s.list(ctx, src, known)
+		if err != nil {
+			return fmt.Errorf("sync: listing repos: %w", err)
+		}
+		all = append(all, rs...)
+	}
+
+	if err := s.Store.UpsertRepos(ctx, all...); err != nil {
+		return fmt.Errorf("sync: upserting repos: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Syncer) list(ctx context.Context, src Source, known map[string]RepoSyncFingerprint) ([]*Repo, error) {
+	if s.Mode == SyncIncremental {
+		if incr, ok := src.(IncrementalSource); ok {
+			return incr.ListReposSince(ctx, known)
+		}
+		log15.Debug("sync: source doesn't support incremental sync, falling back to a full list", "source", fmt.Sprintf("%T", src))
+	}
+
+	return src.ListRepos(ctx)
+}
+
+func fingerprintKey(id api.ExternalRepoSpec) string {
+	return id.ServiceID + ":" + id.ServiceType + ":" + id.ID
+}
@@ -0,0 +1,319 @@
+package repos_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/repo-updater/repos"
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc/github"
+)
+
+func TestSyncer(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		test func(repos.Store) func(*testing.T)
+	}{
+		{"ListReposForSync", testListReposForSync},
+		{"ListReposForSyncExcludesDeletedRepos", testListReposForSyncExcludesDeletedRepos},
+		{"IncrementalSyncSkipsUnchangedRepos", testIncrementalSyncSkipsUnchangedRepos},
+		{"IncrementalSyncDoesNotResurrectDeletedRepos", testIncrementalSyncDoesNotResurrectDeletedRepos},
+	} {
+		t.Run(tc.name, tc.test(repos.NewOperationStore(
+			new(repos.FakeStore),
+			"github.com/test/syncer",
+		)))
+	}
+}
+
+func testListReposForSync(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ctx := context.Background()
+		now := time.Now()
+
+		base := &repos.Repo{
+			Name: "github.com/foo/projection",
+			ExternalRepo: api.ExternalRepoSpec{
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+			},
+			Sources:  map[string]*repos.SourceInfo{},
+			Metadata: new(github.Repository),
+		}
+
+		seed := mkRepos(512, base)
+		for i, r := range seed {
+			r.ExternalRepo.ID = strconv.Itoa(i)
+			r.UpstreamFingerprint = "etag-" + strconv.Itoa(i)
+			r.UpdatedAt = now
+		}
+
+		if err := store.UpsertRepos(ctx, seed...); err != nil {
+			t.Fatalf("failed to seed store: %v", err)
+		}
+
+		ss, ok := store.(interface {
+			ListReposForSync(context.Context, []string) ([]repos.RepoSyncFingerprint, error)
+		})
+		if !ok {
+			t.Fatalf("store %T does not implement ListReposForSync", store)
+		}
+
+		fps, err := ss.ListReposForSync(ctx, []string{"github"})
+		if err != nil {
+			t.Fatalf("ListReposForSync error: %s", err)
+		}
+
+		if len(fps) != 512 {
+			t.Fatalf("expected 512 fingerprints, got %d", len(fps))
+		}
+
+		for _, fp := range fps {
+			if fp.UpstreamFingerprint == "" {
+				t.Fatalf("fingerprint for repo %d is empty", fp.ID)
+			}
+		}
+	}
+}
+
+func testIncrementalSyncSkipsUnchangedRepos(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ctx := context.Background()
+		now := time.Now()
+
+		base := &repos.Repo{
+			Name: "github.com/foo/incremental",
+			ExternalRepo: api.ExternalRepoSpec{
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+			},
+			Sources:  map[string]*repos.SourceInfo{},
+			Metadata: new(github.Repository),
+		}
+
+		seed := mkRepos(512, base)
+		for i, r := range seed {
+			r.ExternalRepo.ID = strconv.Itoa(i)
+			r.UpstreamFingerprint = "etag-" + strconv.Itoa(i)
+			r.UpdatedAt = now
+		}
+
+		if err := store.UpsertRepos(ctx, seed...); err != nil {
+			t.Fatalf("failed to seed store: %v", err)
+		}
+
+		src := new(fakeFingerprintSource)
+		syncer := &repos.Syncer{
+			Store:   store,
+			Sources: []repos.Source{src},
+			Mode:    repos.SyncIncremental,
+		}
+
+		if err := syncer.Sync(ctx, []string{"github"}); err != nil {
+			t.Fatalf("Sync error: %s", err)
+		}
+
+		// The real assertion: a sync that actually trusted local
+		// fingerprints never asked the source to refetch. Checking only
+		// that UpdatedAt didn't change wouldn't catch a Syncer that
+		// skipped ListReposSince entirely and fell back to a full list
+		// returning zero repos, since that would leave the seeded state
+		// untouched too.
+		if src.listReposCalls != 0 {
+			t.Errorf("expected source's ListRepos (full) never called, got %d calls", src.listReposCalls)
+		}
+		if src.listReposSinceCalls != 1 {
+			t.Errorf("expected source's ListReposSince called once, got %d calls", src.listReposSinceCalls)
+		}
+
+		have, err := store.ListRepos(ctx, repos.StoreListReposArgs{Kinds: []string{"github"}})
+		if err != nil {
+			t.Fatalf("ListRepos error: %s", err)
+		}
+
+		if len(have) != 512 {
+			t.Fatalf("expected 512 repos, got %d", len(have))
+		}
+
+		for _, r := range have {
+			if !r.UpdatedAt.Equal(now) {
+				t.Errorf("UpdatedAt advanced for unchanged repo %s: have %s, want %s", r.Name, r.UpdatedAt, now)
+			}
+		}
+	}
+}
+
+func testListReposForSyncExcludesDeletedRepos(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ctx := context.Background()
+		now := time.Now()
+
+		repo := &repos.Repo{
+			Name: "github.com/foo/deleted-projection",
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          "deleted-projection",
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+			},
+			Sources:             map[string]*repos.SourceInfo{},
+			Metadata:            new(github.Repository),
+			UpstreamFingerprint: "etag-deleted-projection",
+			UpdatedAt:           now,
+		}
+
+		if err := store.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("failed to seed store: %v", err)
+		}
+
+		repo.DeletedAt = now
+		if err := store.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("failed to soft-delete repo: %v", err)
+		}
+
+		ss, ok := store.(interface {
+			ListReposForSync(context.Context, []string) ([]repos.RepoSyncFingerprint, error)
+		})
+		if !ok {
+			t.Fatalf("store %T does not implement ListReposForSync", store)
+		}
+
+		fps, err := ss.ListReposForSync(ctx, []string{"github"})
+		if err != nil {
+			t.Fatalf("ListReposForSync error: %s", err)
+		}
+
+		for _, fp := range fps {
+			if fp.ExternalRepo.ID == repo.ExternalRepo.ID {
+				t.Fatalf("deleted repo %s was returned by ListReposForSync", fp.ExternalRepo.ID)
+			}
+		}
+	}
+}
+
+func testIncrementalSyncDoesNotResurrectDeletedRepos(store repos.Store) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+
+		ctx := context.Background()
+		now := time.Now()
+
+		repo := &repos.Repo{
+			Name: "github.com/foo/deleted-sync",
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          "deleted-sync",
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+			},
+			Sources:             map[string]*repos.SourceInfo{},
+			Metadata:            new(github.Repository),
+			UpstreamFingerprint: "etag-deleted-sync",
+			UpdatedAt:           now,
+		}
+
+		if err := store.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("failed to seed store: %v", err)
+		}
+
+		repo.DeletedAt = now
+		if err := store.UpsertRepos(ctx, repo); err != nil {
+			t.Fatalf("failed to soft-delete repo: %v", err)
+		}
+
+		syncer := &repos.Syncer{
+			Store:   store,
+			Sources: []repos.Source{new(fakeFingerprintSource)},
+			Mode:    repos.SyncIncremental,
+		}
+
+		if err := syncer.Sync(ctx, []string{"github"}); err != nil {
+			t.Fatalf("Sync error: %s", err)
+		}
+
+		have, err := store.ListRepos(ctx, repos.StoreListReposArgs{Kinds: []string{"github"}})
+		if err != nil {
+			t.Fatalf("ListRepos error: %s", err)
+		}
+
+		for _, r := range have {
+			if r.ExternalRepo.ID == repo.ExternalRepo.ID {
+				t.Fatalf("deleted repo %s was resurrected by incremental sync", r.ExternalRepo.ID)
+			}
+		}
+
+		// Default listings excluding deleted repos would look the same
+		// whether this repo was correctly left alone or just never
+		// touched at all. Listing with Deleted: true confirms it's still
+		// there with DeletedAt intact, rather than having disappeared
+		// from the store entirely.
+		deleted, err := store.ListRepos(ctx, repos.StoreListReposArgs{Kinds: []string{"github"}, Deleted: true})
+		if err != nil {
+			t.Fatalf("ListRepos(Deleted: true) error: %s", err)
+		}
+
+		var found bool
+		for _, r := range deleted {
+			if r.ExternalRepo.ID == repo.ExternalRepo.ID {
+				found = true
+				if r.DeletedAt.IsZero() {
+					t.Errorf("repo %s had its DeletedAt cleared by incremental sync", r.ExternalRepo.ID)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("deleted repo %s is missing from the store entirely", repo.ExternalRepo.ID)
+		}
+	}
+}
+
+func TestSyncerIncrementalWithoutSyncStore(t *testing.T) {
+	t.Parallel()
+
+	// SyncIncremental must also work against a Store that doesn't
+	// implement the syncStore optional interface (every Store but
+	// OperationStore), falling back to deriving fingerprints from
+	// ListRepos instead of failing.
+	testIncrementalSyncSkipsUnchangedRepos(new(repos.FakeStore))(t)
+}
+
+// fakeFingerprintSource is an IncrementalSource test double that trusts
+// whatever fingerprints it's handed and passes each one through as a Repo
+// verbatim, simulating a code host that reported no changes since the
+// last sync. It counts calls to each method so tests can assert on which
+// sync path actually ran, rather than inferring it from field values
+// that could coincidentally match either path.
+type fakeFingerprintSource struct {
+	listReposCalls      int
+	listReposSinceCalls int
+}
+
+func (s *fakeFingerprintSource) ListRepos(ctx context.Context) ([]*repos.Repo, error) {
+	s.listReposCalls++
+	return nil, nil
+}
+
+func (s *fakeFingerprintSource) ListReposSince(ctx context.Context, known map[string]repos.RepoSyncFingerprint) ([]*repos.Repo, error) {
+	s.listReposSinceCalls++
+
+	rs := make([]*repos.Repo, 0, len(known))
+	for _, fp := range known {
+		rs = append(rs, &repos.Repo{
+			ID:                  fp.ID,
+			Name:                "github.com/foo/incremental" + fp.ExternalRepo.ID,
+			ExternalRepo:        fp.ExternalRepo,
+			UpstreamFingerprint: fp.UpstreamFingerprint,
+			UpdatedAt:           fp.UpdatedAt,
+			Sources:             map[string]*repos.SourceInfo{},
+		})
+	}
+	return rs, nil
+}